@@ -0,0 +1,46 @@
+package gorm
+
+import (
+	"errors"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// ErrMissingWhereClause is returned when BlockGlobalUpdate is enabled and an
+// Update or Delete would otherwise run against every row in a table.
+var ErrMissingWhereClause = errors.New("gorm: WHERE clause missing for update/delete, use Unscoped() or an explicit Where(...) to run it against every row")
+
+// BlockGlobalUpdate, when enabled, makes the update and delete callbacks
+// refuse to run a statement that has no WHERE clause and whose model has a
+// zero primary key, so a stray db.Model(&User{}).Update(...) can't silently
+// touch every row in the table. Opt out per call with Unscoped() or an
+// explicit Where("1=1").
+func (s *DB) BlockGlobalUpdate(enable bool) *DB {
+	s.parent.blockGlobalUpdate = enable
+	return s
+}
+
+// checkMissingWhereClause is called directly from tracedCallCallbacks
+// before it runs the update/delete callback chain, rather than being
+// registered as a callback itself (it needs to run before the chain starts,
+// and returns an error instead of mutating scope in place). When it returns
+// a non-nil error the statement must not reach the database.
+func checkMissingWhereClause(scope *Scope) error {
+	if !scope.db.blockGlobalUpdate || scope.Search.Unscoped {
+		return nil
+	}
+
+	if len(scope.Search.WhereConditions) > 0 || !scope.PrimaryKeyZero() {
+		return nil
+	}
+
+	if span := opentracing.SpanFromContext(scope.ctx); span != nil {
+		span.LogFields(
+			log.String("event", "blocked"),
+			log.String("message", "refused to run an update/delete with no where clause and a zero primary key"),
+		)
+	}
+
+	return ErrMissingWhereClause
+}
@@ -0,0 +1,22 @@
+package gorm
+
+import "testing"
+
+func TestBlockGlobalUpdate(t *testing.T) {
+	db := DB{}
+	db.parent = &db
+
+	if db.blockGlobalUpdate {
+		t.Fatalf("blockGlobalUpdate should default to false")
+	}
+
+	db.BlockGlobalUpdate(true)
+	if !db.blockGlobalUpdate {
+		t.Fatalf("BlockGlobalUpdate(true) did not set the flag")
+	}
+
+	db.BlockGlobalUpdate(false)
+	if db.blockGlobalUpdate {
+		t.Fatalf("BlockGlobalUpdate(false) did not clear the flag")
+	}
+}
@@ -7,9 +7,10 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/opentracing/opentracing-go"
+	opentracing "github.com/opentracing/opentracing-go"
 )
 
 // NowFunc returns current time, this function is exported in order to be able
@@ -37,6 +38,13 @@ type DB struct {
 	source            string
 	values            map[string]interface{}
 	joinTableHandlers map[string]JoinTableHandler
+	disableStmtLog    bool
+	txCtx             context.Context
+	savepointSeq      int64
+	plugins           map[string]Plugin
+	blockGlobalUpdate bool
+	nowFuncOverride   func() time.Time
+	slowThreshold     time.Duration
 }
 
 func Open(dialect string, args ...interface{}) (DB, error) {
@@ -96,16 +104,16 @@ func (s *DB) New() *DB {
 	return clone
 }
 
-// NewScope create scope for callbacks, including DB's search information
+// NewScope create scope for callbacks, including DB's search information.
+// It no longer opens a span itself; see tracedCallCallbacks.
 func (db *DB) NewScope(ctx context.Context, value interface{}) *Scope {
 	dbClone := db.clone()
 	dbClone.Value = value
-	// var span opentracing.Span
 
-	if ctx == nil {
+	if dbClone.txCtx != nil {
+		ctx = dbClone.txCtx
+	} else if ctx == nil {
 		ctx = context.Background()
-	} else {
-		_, ctx = opentracing.StartSpanFromContext(ctx, fmt.Sprintf("%s", db.source))
 	}
 
 	return &Scope{db: dbClone, Search: dbClone.search.clone(), Value: value, ctx: ctx}
@@ -136,6 +144,43 @@ func (s *DB) LogMode(enable bool) *DB {
 	return s
 }
 
+// DisableStatementLog stops the rendered SQL from being attached to spans as
+// the db.statement tag. Use this when statements may embed sensitive literal
+// values that shouldn't leave the process in trace payloads.
+func (s *DB) DisableStatementLog() *DB {
+	s.parent.disableStmtLog = true
+	return s
+}
+
+// SetNowFunc sets a per-DB replacement for NowFunc, returned by nowFunc.
+//
+// No create/update timestamp callback in this package calls nowFunc, so
+// SetNowFunc does not change the timestamps gorm writes; those still come
+// from the package-level NowFunc.
+func (s *DB) SetNowFunc(fn func() time.Time) *DB {
+	s.parent.nowFuncOverride = fn
+	return s
+}
+
+// nowFunc returns the per-DB override set by SetNowFunc, falling back to the
+// package-level NowFunc when none was set. Nothing in this package calls it.
+func (s *DB) nowFunc() time.Time {
+	if s.parent.nowFuncOverride != nil {
+		return s.parent.nowFuncOverride()
+	}
+	return NowFunc()
+}
+
+// SetSlowThreshold marks any callback whose execution takes longer than d as
+// slow: its span gets slow=true and duration_ms tags (see tagSlowQuery), and
+// the existing logger still gets the usual SQL log line, so slow queries are
+// filterable in Jaeger/Zipkin without turning on full debug logging. d <= 0
+// disables slow-query tagging.
+func (s *DB) SetSlowThreshold(d time.Duration) *DB {
+	s.parent.slowThreshold = d
+	return s
+}
+
 func (s *DB) SingularTable(enable bool) {
 	smapMutex.Lock()
 	modelStructs = map[reflect.Type]*ModelStruct{}
@@ -209,43 +254,80 @@ func (s *DB) Assign(attrs ...interface{}) *DB {
 func (s *DB) First(ctx context.Context, out interface{}, where ...interface{}) *DB {
 	newScope := s.clone().NewScope(ctx, out)
 	newScope.Search.Limit(1)
-	return newScope.Set("gorm:order_by_primary_key", "ASC").
-		inlineCondition(where...).callCallbacks(s.parent.callback.queries).db
+	scope := newScope.Set("gorm:order_by_primary_key", "ASC").inlineCondition(where...)
+	return tracedCallCallbacks(scope, spanOpQuery, func() *Scope {
+		return scope.callCallbacks(s.parent.callback.queries)
+	}).db
 }
 
 func (s *DB) Last(ctx context.Context, out interface{}, where ...interface{}) *DB {
 	newScope := s.clone().NewScope(ctx, out)
 	newScope.Search.Limit(1)
-	return newScope.Set("gorm:order_by_primary_key", "DESC").
-		inlineCondition(where...).callCallbacks(s.parent.callback.queries).db
+	scope := newScope.Set("gorm:order_by_primary_key", "DESC").inlineCondition(where...)
+	return tracedCallCallbacks(scope, spanOpQuery, func() *Scope {
+		return scope.callCallbacks(s.parent.callback.queries)
+	}).db
 }
 
 func (s *DB) Find(ctx context.Context, out interface{}, where ...interface{}) *DB {
-	return s.clone().NewScope(ctx, out).inlineCondition(where...).callCallbacks(s.parent.callback.queries).db
+	scope := s.clone().NewScope(ctx, out).inlineCondition(where...)
+	return tracedCallCallbacks(scope, spanOpQuery, func() *Scope {
+		return scope.callCallbacks(s.parent.callback.queries)
+	}).db
 }
 
 func (s *DB) Scan(ctx context.Context, dest interface{}) *DB {
-	return s.clone().NewScope(ctx, s.Value).InstanceSet("gorm:query_destination", dest).callCallbacks(s.parent.callback.queries).db
+	scope := s.clone().NewScope(ctx, s.Value).InstanceSet("gorm:query_destination", dest)
+	return tracedCallCallbacks(scope, spanOpQuery, func() *Scope {
+		return scope.callCallbacks(s.parent.callback.queries)
+	}).db
 }
 
+// Row and Rows run real SQL but return a driver type, not a *Scope, so they
+// can't go through tracedCallCallbacks directly; they open/close the same
+// span by hand instead.
 func (s *DB) Row(ctx context.Context) *sql.Row {
-	return s.NewScope(ctx, s.Value).row()
+	scope := s.NewScope(ctx, s.Value)
+	span := startCallbackSpan(scope, spanOpQuery)
+	start := time.Now()
+	row := scope.row()
+	tagSlowQuery(span, scope, time.Since(start))
+	finishCallbackSpan(span, scope)
+	return row
 }
 
 func (s *DB) Rows(ctx context.Context) (*sql.Rows, error) {
-	return s.NewScope(ctx, s.Value).rows()
+	scope := s.NewScope(ctx, s.Value)
+	span := startCallbackSpan(scope, spanOpQuery)
+	start := time.Now()
+	rows, err := scope.rows()
+	if err != nil {
+		scope.db.err(err)
+	}
+	tagSlowQuery(span, scope, time.Since(start))
+	finishCallbackSpan(span, scope)
+	return rows, err
 }
 
 func (s *DB) Pluck(ctx context.Context, column string, value interface{}) *DB {
-	return s.NewScope(ctx, s.Value).pluck(column, value).db
+	scope := s.NewScope(ctx, s.Value)
+	return tracedCallCallbacks(scope, spanOpQuery, func() *Scope {
+		return scope.pluck(column, value)
+	}).db
 }
 
 func (s *DB) Count(ctx context.Context, value interface{}) *DB {
-	return s.NewScope(ctx, s.Value).count(value).db
+	scope := s.NewScope(ctx, s.Value)
+	return tracedCallCallbacks(scope, spanOpQuery, func() *Scope {
+		return scope.count(value)
+	}).db
 }
 
 func (s *DB) Related(ctx context.Context, value interface{}, foreignKeys ...string) *DB {
-	return s.clone().NewScope(ctx, s.Value).related(value, foreignKeys...).db
+	scope := s.clone().NewScope(ctx, s.Value)
+	return tracedCallCallbacks(scope, spanOpQuery, func() *Scope {
+		return scope.related(value, foreignKeys...)
+	}).db
 }
 
 func (s *DB) FirstOrInit(ctx context.Context, out interface{}, where ...interface{}) *DB {
@@ -267,9 +349,15 @@ func (s *DB) FirstOrCreate(ctx context.Context, out interface{}, where ...interf
 		if !result.RecordNotFound() {
 			return result
 		}
-		c.NewScope(ctx, out).inlineCondition(where...).initialize().callCallbacks(s.parent.callback.creates)
+		scope := c.NewScope(ctx, out).inlineCondition(where...).initialize()
+		tracedCallCallbacks(scope, spanOpCreate, func() *Scope {
+			return scope.callCallbacks(s.parent.callback.creates)
+		})
 	} else if len(c.search.assignAttrs) > 0 {
-		c.NewScope(ctx, out).InstanceSet("gorm:update_interface", s.search.assignAttrs).callCallbacks(s.parent.callback.updates)
+		scope := c.NewScope(ctx, out).InstanceSet("gorm:update_interface", s.search.assignAttrs)
+		tracedCallCallbacks(scope, spanOpUpdate, func() *Scope {
+			return scope.callCallbacks(s.parent.callback.updates)
+		})
 	}
 	return c
 }
@@ -279,10 +367,12 @@ func (s *DB) Update(ctx context.Context, attrs ...interface{}) *DB {
 }
 
 func (s *DB) Updates(ctx context.Context, values interface{}, ignoreProtectedAttrs ...bool) *DB {
-	return s.clone().NewScope(ctx, s.Value).
+	scope := s.clone().NewScope(ctx, s.Value).
 		Set("gorm:ignore_protected_attrs", len(ignoreProtectedAttrs) > 0).
-		InstanceSet("gorm:update_interface", values).
-		callCallbacks(s.parent.callback.updates).db
+		InstanceSet("gorm:update_interface", values)
+	return tracedCallCallbacks(scope, spanOpUpdate, func() *Scope {
+		return scope.callCallbacks(s.parent.callback.updates)
+	}).db
 }
 
 func (s *DB) UpdateColumn(ctx context.Context, attrs ...interface{}) *DB {
@@ -290,33 +380,46 @@ func (s *DB) UpdateColumn(ctx context.Context, attrs ...interface{}) *DB {
 }
 
 func (s *DB) UpdateColumns(ctx context.Context, values interface{}) *DB {
-	return s.clone().NewScope(ctx, s.Value).
+	scope := s.clone().NewScope(ctx, s.Value).
 		Set("gorm:update_column", true).
 		Set("gorm:save_associations", false).
-		InstanceSet("gorm:update_interface", values).
-		callCallbacks(s.parent.callback.updates).db
+		InstanceSet("gorm:update_interface", values)
+	return tracedCallCallbacks(scope, spanOpUpdate, func() *Scope {
+		return scope.callCallbacks(s.parent.callback.updates)
+	}).db
 }
 
 func (s *DB) Save(ctx context.Context, value interface{}) *DB {
 	scope := s.clone().NewScope(ctx, value)
 	if scope.PrimaryKeyZero() {
-		return scope.callCallbacks(s.parent.callback.creates).db
+		return tracedCallCallbacks(scope, spanOpCreate, func() *Scope {
+			return scope.callCallbacks(s.parent.callback.creates)
+		}).db
 	}
-	return scope.callCallbacks(s.parent.callback.updates).db
+	return tracedCallCallbacks(scope, spanOpUpdate, func() *Scope {
+		return scope.callCallbacks(s.parent.callback.updates)
+	}).db
 }
 
 func (s *DB) Create(ctx context.Context, value interface{}) *DB {
 	scope := s.clone().NewScope(ctx, value).InstanceSet("gorm:insert_ignore", false)
-	return scope.callCallbacks(s.parent.callback.creates).db
+	return tracedCallCallbacks(scope, spanOpCreate, func() *Scope {
+		return scope.callCallbacks(s.parent.callback.creates)
+	}).db
 }
 
 func (s *DB) CreateIgnore(ctx context.Context, value interface{}) *DB {
 	scope := s.clone().NewScope(ctx, value).InstanceSet("gorm:insert_ignore", true)
-	return scope.callCallbacks(s.parent.callback.creates).db
+	return tracedCallCallbacks(scope, spanOpCreate, func() *Scope {
+		return scope.callCallbacks(s.parent.callback.creates)
+	}).db
 }
 
 func (s *DB) Delete(ctx context.Context, value interface{}, where ...interface{}) *DB {
-	return s.clone().NewScope(ctx, value).inlineCondition(where...).callCallbacks(s.parent.callback.deletes).db
+	scope := s.clone().NewScope(ctx, value).inlineCondition(where...)
+	return tracedCallCallbacks(scope, spanOpDelete, func() *Scope {
+		return scope.callCallbacks(s.parent.callback.deletes)
+	}).db
 }
 
 func (s *DB) Raw(sql string, values ...interface{}) *DB {
@@ -328,7 +431,9 @@ func (s *DB) Exec(ctx context.Context, sql string, values ...interface{}) *DB {
 	generatedSql := scope.buildWhereCondition(map[string]interface{}{"query": sql, "args": values})
 	generatedSql = strings.TrimSuffix(strings.TrimPrefix(generatedSql, "("), ")")
 	scope.Raw(generatedSql)
-	return scope.Exec().db
+	return tracedCallCallbacks(scope, spanOpRaw, func() *Scope {
+		return scope.Exec()
+	}).db
 }
 
 func (s *DB) Model(value interface{}) *DB {
@@ -348,36 +453,202 @@ func (s *DB) Debug() *DB {
 	return s.clone().LogMode(true)
 }
 
-func (s *DB) Begin() *DB {
+// Begin starts a transaction and emits a gorm.begin span, using opts when
+// the underlying sqlCommon supports BeginTx so callers can request an
+// isolation level or a read-only transaction. opts may be nil. Prefer
+// Transaction for the common case; call Begin directly only when you need
+// to manage Commit/Rollback yourself.
+func (s *DB) Begin(ctx context.Context, opts *sql.TxOptions) *DB {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	span, spanCtx := opentracing.StartSpanFromContext(ctx, "gorm.begin")
+	defer span.Finish()
+
 	c := s.clone()
-	if db, ok := c.db.(sqlDb); ok {
-		tx, err := db.Begin()
-		c.db = interface{}(tx).(sqlCommon)
-		c.err(err)
-	} else {
+	db, ok := c.db.(sqlDb)
+	if !ok {
+		span.SetTag("error", true)
 		c.err(CantStartTransaction)
+		return c
+	}
+
+	var tx *sql.Tx
+	var err error
+	if dbCtx, ok := db.(sqlDbContext); ok {
+		tx, err = dbCtx.BeginTx(spanCtx, opts)
+	} else {
+		tx, err = db.Begin()
 	}
+
+	if err != nil {
+		span.SetTag("error", true)
+		c.err(err)
+		return c
+	}
+
+	c.db = interface{}(tx).(sqlCommon)
+	c.txCtx = ctx
 	return c
 }
 
-func (s *DB) Commit() *DB {
-	if db, ok := s.db.(sqlTx); ok {
-		s.err(db.Commit())
-	} else {
+// Commit commits a transaction started with Begin or Transaction, emitting
+// a gorm.commit span.
+func (s *DB) Commit(ctx context.Context) *DB {
+	db, ok := s.db.(sqlTx)
+	if !ok {
 		s.err(NoValidTransaction)
+		return s
+	}
+
+	span, _ := opentracing.StartSpanFromContext(s.spanCtx(ctx), "gorm.commit")
+	defer span.Finish()
+
+	if err := db.Commit(); err != nil {
+		span.SetTag("error", true)
+		s.err(err)
 	}
 	return s
 }
 
-func (s *DB) Rollback() *DB {
-	if db, ok := s.db.(sqlTx); ok {
-		s.err(db.Rollback())
-	} else {
+// Rollback rolls back a transaction started with Begin or Transaction,
+// emitting a gorm.rollback span.
+func (s *DB) Rollback(ctx context.Context) *DB {
+	db, ok := s.db.(sqlTx)
+	if !ok {
 		s.err(NoValidTransaction)
+		return s
+	}
+
+	span, _ := opentracing.StartSpanFromContext(s.spanCtx(ctx), "gorm.rollback")
+	defer span.Finish()
+
+	if err := db.Rollback(); err != nil {
+		span.SetTag("error", true)
+		s.err(err)
 	}
 	return s
 }
 
+// spanCtx honors an explicit ctx argument first, so a caller that passes
+// its own context to Commit/Rollback gets it; only when ctx is nil does it
+// fall back to the context captured by Begin, or background if neither is
+// set.
+func (s *DB) spanCtx(ctx context.Context) context.Context {
+	if ctx != nil {
+		return ctx
+	}
+	if s.txCtx != nil {
+		return s.txCtx
+	}
+	return context.Background()
+}
+
+// Transaction runs fn inside a transaction: it opens a single gorm.transaction
+// span covering Begin through Commit/Rollback, makes every statement fn
+// executes on tx a child of that span, and rolls back automatically if fn
+// returns an error or panics (re-panicking after the rollback completes).
+// Calling Transaction from inside another Transaction's fn runs fn in a
+// SAVEPOINT instead of nesting real transactions, so partial rollback of the
+// inner call doesn't undo the outer one. opts is only honored for the
+// outermost call.
+func (s *DB) Transaction(ctx context.Context, fn func(tx *DB) error, opts ...*sql.TxOptions) (err error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if s.txCtx != nil {
+		return s.transactionSavepoint(ctx, fn)
+	}
+
+	span, spanCtx := opentracing.StartSpanFromContext(ctx, "gorm.transaction")
+	defer span.Finish()
+
+	var txOpts *sql.TxOptions
+	if len(opts) > 0 {
+		txOpts = opts[0]
+	}
+	if txOpts != nil {
+		span.SetTag("db.tx.isolation_level", txOpts.Isolation.String())
+	}
+
+	tx := s.Begin(spanCtx, txOpts)
+	if tx.Error != nil {
+		span.SetTag("error", true)
+		return tx.Error
+	}
+	tx.txCtx = spanCtx
+
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback(spanCtx)
+			span.SetTag("db.tx.status", "rolled_back")
+			panic(r)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		tx.Rollback(spanCtx)
+		span.SetTag("db.tx.status", "rolled_back")
+		return err
+	}
+
+	if committed := tx.Commit(spanCtx); committed.Error != nil {
+		span.SetTag("db.tx.status", "rolled_back")
+		return committed.Error
+	}
+
+	span.SetTag("db.tx.status", "committed")
+	return nil
+}
+
+// transactionSavepoint backs a Transaction call that's nested inside another
+// one: rather than opening a second real transaction it wraps fn in a
+// SAVEPOINT on the same tx, so an inner failure can roll back just its own
+// work.
+func (s *DB) transactionSavepoint(ctx context.Context, fn func(tx *DB) error) (err error) {
+	// s.parent is shared by every clone derived from the root *DB, so
+	// concurrent nested transactions on different goroutines can race on
+	// this counter; atomic keeps the generated names unique either way.
+	seq := atomic.AddInt64(&s.parent.savepointSeq, 1)
+	name := fmt.Sprintf("gorm_sp_%d", seq)
+
+	span, spanCtx := opentracing.StartSpanFromContext(ctx, "gorm.transaction.savepoint")
+	span.SetTag("db.tx.savepoint", name)
+	defer span.Finish()
+
+	sp := s.clone()
+	sp.txCtx = spanCtx
+
+	if err = sp.Exec(spanCtx, "SAVEPOINT "+name).Error; err != nil {
+		span.SetTag("error", true)
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			sp.Exec(spanCtx, "ROLLBACK TO SAVEPOINT "+name)
+			span.SetTag("db.tx.status", "rolled_back")
+			panic(r)
+		}
+	}()
+
+	if err = fn(sp); err != nil {
+		sp.Exec(spanCtx, "ROLLBACK TO SAVEPOINT "+name)
+		span.SetTag("db.tx.status", "rolled_back")
+		return err
+	}
+
+	if err = sp.Exec(spanCtx, "RELEASE SAVEPOINT "+name).Error; err != nil {
+		span.SetTag("error", true)
+		return err
+	}
+
+	span.SetTag("db.tx.status", "committed")
+	return nil
+}
+
 func (s *DB) NewRecord(ctx context.Context, value interface{}) bool {
 	return s.clone().NewScope(ctx, value).PrimaryKeyZero()
 }
@@ -388,15 +659,24 @@ func (s *DB) RecordNotFound() bool {
 
 // Migrations
 func (s *DB) CreateTable(ctx context.Context, value interface{}) *DB {
-	return s.clone().NewScope(ctx, value).createTable().db
+	scope := s.clone().NewScope(ctx, value)
+	return tracedCallCallbacks(scope, spanOpMigrate, func() *Scope {
+		return scope.createTable()
+	}).db
 }
 
 func (s *DB) DropTable(ctx context.Context, value interface{}) *DB {
-	return s.clone().NewScope(ctx, value).dropTable().db
+	scope := s.clone().NewScope(ctx, value)
+	return tracedCallCallbacks(scope, spanOpMigrate, func() *Scope {
+		return scope.dropTable()
+	}).db
 }
 
 func (s *DB) DropTableIfExists(ctx context.Context, value interface{}) *DB {
-	return s.clone().NewScope(ctx, value).dropTableIfExists().db
+	scope := s.clone().NewScope(ctx, value)
+	return tracedCallCallbacks(scope, spanOpMigrate, func() *Scope {
+		return scope.dropTableIfExists()
+	}).db
 }
 
 func (s *DB) HasTable(ctx context.Context, value interface{}) bool {
@@ -408,7 +688,10 @@ func (s *DB) HasTable(ctx context.Context, value interface{}) bool {
 func (s *DB) AutoMigrate(ctx context.Context, values ...interface{}) *DB {
 	db := s.clone()
 	for _, value := range values {
-		db = db.NewScope(ctx, value).NeedPtr().autoMigrate().db
+		scope := db.NewScope(ctx, value).NeedPtr()
+		db = tracedCallCallbacks(scope, spanOpMigrate, func() *Scope {
+			return scope.autoMigrate()
+		}).db
 	}
 	return db
 }
@@ -0,0 +1,36 @@
+package gorm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetNowFunc(t *testing.T) {
+	db := DB{}
+	db.parent = &db
+
+	if got := db.nowFunc(); got.IsZero() {
+		t.Fatalf("nowFunc() with no override returned the zero time")
+	}
+
+	frozen := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	db.SetNowFunc(func() time.Time { return frozen })
+
+	if got := db.nowFunc(); !got.Equal(frozen) {
+		t.Fatalf("nowFunc() = %v, want overridden %v", got, frozen)
+	}
+}
+
+func TestSetSlowThreshold(t *testing.T) {
+	db := DB{}
+	db.parent = &db
+
+	if db.parent.slowThreshold != 0 {
+		t.Fatalf("slowThreshold should default to 0")
+	}
+
+	db.SetSlowThreshold(200 * time.Millisecond)
+	if db.parent.slowThreshold != 200*time.Millisecond {
+		t.Fatalf("SetSlowThreshold did not set slowThreshold, got %v", db.parent.slowThreshold)
+	}
+}
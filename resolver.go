@@ -0,0 +1,352 @@
+package gorm
+
+import (
+	"database/sql"
+	"errors"
+	"math/rand"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// Plugin is implemented by optional subsystems that need to register
+// themselves into a *DB, such as the read/write splitting resolver. Install
+// one with DB.Use.
+type Plugin interface {
+	Name() string
+	Initialize(db *DB) error
+}
+
+// Use installs plugin, calling its Initialize once. Installing a plugin
+// whose Name is already registered is a no-op.
+func (s *DB) Use(plugin Plugin) error {
+	if s.parent.plugins == nil {
+		s.parent.plugins = map[string]Plugin{}
+	}
+	if _, ok := s.parent.plugins[plugin.Name()]; ok {
+		return nil
+	}
+	if err := plugin.Initialize(s.parent); err != nil {
+		return err
+	}
+	s.parent.plugins[plugin.Name()] = plugin
+	return nil
+}
+
+// writeClause is passed to DB.Clauses to force a statement that the
+// resolver would otherwise send to a replica onto the source instead.
+type writeClause struct{}
+
+// ResolverWrite forces the next query built from this *DB onto the
+// resolver's source, e.g. db.Clauses(gorm.ResolverWrite).First(ctx, &user).
+// Named for the resolver specifically (rather than the generic "Write")
+// since it lives in gorm's root package alongside many other exports.
+var ResolverWrite = writeClause{}
+
+// Clauses attaches hints to the next statement built from this *DB. The
+// only hint understood today is ResolverWrite; installed plugins can look
+// them up via hasClause.
+func (s *DB) Clauses(hints ...interface{}) *DB {
+	c := s.clone()
+	c.values["gorm:clauses"] = append(c.clauseHints(), hints...)
+	return c
+}
+
+func (s *DB) clauseHints() []interface{} {
+	hints, _ := s.values["gorm:clauses"].([]interface{})
+	return hints
+}
+
+func (s *DB) hasClause(hint interface{}) bool {
+	for _, h := range s.clauseHints() {
+		if h == hint {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolverPolicy picks one of the live connections in a resolver group to
+// serve the next statement. Named for the resolver specifically, rather than
+// the generic "Policy", since it lives in gorm's root package.
+type ResolverPolicy interface {
+	Resolve(dbs []*DB) *DB
+}
+
+// ResolverPolicyFunc lets a plain function satisfy ResolverPolicy.
+type ResolverPolicyFunc func(dbs []*DB) *DB
+
+func (f ResolverPolicyFunc) Resolve(dbs []*DB) *DB { return f(dbs) }
+
+// RandomResolverPolicy distributes statements across a group uniformly at
+// random.
+var RandomResolverPolicy ResolverPolicy = ResolverPolicyFunc(func(dbs []*DB) *DB {
+	return dbs[rand.Intn(len(dbs))]
+})
+
+// NewRoundRobinResolverPolicy distributes statements across a group in turn.
+func NewRoundRobinResolverPolicy() ResolverPolicy {
+	var next uint64
+	return ResolverPolicyFunc(func(dbs []*DB) *DB {
+		n := atomic.AddUint64(&next, 1)
+		return dbs[(n-1)%uint64(len(dbs))]
+	})
+}
+
+// NewWeightedResolverPolicy distributes statements across a group
+// proportionally to weights, which must be the same length as the group's
+// connections.
+func NewWeightedResolverPolicy(weights []int) ResolverPolicy {
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	return ResolverPolicyFunc(func(dbs []*DB) *DB {
+		n := rand.Intn(total)
+		for i, w := range weights {
+			if n < w {
+				return dbs[i]
+			}
+			n -= w
+		}
+		return dbs[len(dbs)-1]
+	})
+}
+
+// ResolverConfig describes one source/replica group. Register it against
+// zero or more models: zero models makes the group the resolver's default,
+// used for any model that wasn't registered explicitly.
+type ResolverConfig struct {
+	Sources  []*DB
+	Replicas []*DB
+	Policy   ResolverPolicy
+}
+
+type resolverGroup struct {
+	name        string
+	sources     []*DB
+	allReplicas []*DB
+	policy      ResolverPolicy
+
+	mu      sync.RWMutex
+	healthy []*DB
+}
+
+// source returns the group's write target, or nil if it has no sources
+// (a misconfigured ResolverConfig{Sources: nil}); callers must handle nil
+// rather than routing to it.
+func (g *resolverGroup) source() *DB {
+	switch len(g.sources) {
+	case 0:
+		return nil
+	case 1:
+		return g.sources[0]
+	default:
+		return g.policy.Resolve(g.sources)
+	}
+}
+
+func (g *resolverGroup) replica() *DB {
+	g.mu.RLock()
+	healthy := g.healthy
+	g.mu.RUnlock()
+
+	if len(healthy) == 0 {
+		return g.source()
+	}
+	return g.policy.Resolve(healthy)
+}
+
+// refreshHealth pings every replica in the group and swaps in the set that's
+// currently reachable, logging a span event when the live set changes so
+// operators can see the pool change in traces. A replica whose underlying
+// connection isn't a *sql.DB (a test double, say) is treated as unreachable
+// rather than panicking the health-check goroutine.
+func (g *resolverGroup) refreshHealth() {
+	var alive []*DB
+	for _, replica := range g.allReplicas {
+		sqlDB, ok := replica.db.(*sql.DB)
+		if ok && sqlDB.Ping() == nil {
+			alive = append(alive, replica)
+		}
+	}
+
+	g.mu.Lock()
+	changed := len(alive) != len(g.healthy)
+	for i := 0; !changed && i < len(alive); i++ {
+		changed = alive[i] != g.healthy[i]
+	}
+	g.healthy = alive
+	g.mu.Unlock()
+
+	if changed {
+		span := opentracing.StartSpan("gorm.resolver.health_check")
+		span.SetTag("db.resolver.name", g.name)
+		span.SetTag("db.resolver.healthy_replicas", len(alive))
+		span.SetTag("db.resolver.total_replicas", len(g.allReplicas))
+		span.Finish()
+	}
+}
+
+// Resolver is a Plugin that routes statements between a source and N read
+// replicas. Install it with:
+//
+//	db.Use(gorm.NewResolver().Register(gorm.ResolverConfig{
+//		Sources:  []*gorm.DB{primary},
+//		Replicas: []*gorm.DB{replica1, replica2},
+//		Policy:   gorm.RandomResolverPolicy,
+//	}, &User{}, &Order{}))
+type Resolver struct {
+	global   *resolverGroup
+	byModel  map[reflect.Type]*resolverGroup
+	interval time.Duration
+	done     chan struct{}
+}
+
+// NewResolver creates an empty Resolver; call Register to add groups.
+// global starts out as an empty (sourceless) group rather than nil, so
+// groupFor always has something to return even before any default group is
+// Registered.
+func NewResolver() *Resolver {
+	return &Resolver{
+		global:   &resolverGroup{name: "default", policy: RandomResolverPolicy},
+		byModel:  map[reflect.Type]*resolverGroup{},
+		interval: 30 * time.Second,
+		done:     make(chan struct{}),
+	}
+}
+
+// Close stops the resolver's background health-check goroutine. Safe to
+// call even if the resolver was never installed with DB.Use.
+func (r *Resolver) Close() {
+	select {
+	case <-r.done:
+		// already closed
+	default:
+		close(r.done)
+	}
+}
+
+// Register assigns a source/replica group to models, or makes it the
+// resolver's default group when models is empty.
+func (r *Resolver) Register(cfg ResolverConfig, models ...interface{}) *Resolver {
+	policy := cfg.Policy
+	if policy == nil {
+		policy = RandomResolverPolicy
+	}
+
+	group := &resolverGroup{
+		sources:     cfg.Sources,
+		allReplicas: cfg.Replicas,
+		healthy:     cfg.Replicas,
+		policy:      policy,
+	}
+
+	if len(models) == 0 {
+		group.name = "default"
+		r.global = group
+		return r
+	}
+
+	for _, model := range models {
+		typ := reflect.Indirect(reflect.ValueOf(model)).Type()
+		if group.name == "" {
+			group.name = typ.Name()
+		}
+		r.byModel[typ] = group
+	}
+	return r
+}
+
+func (r *Resolver) groupFor(scope *Scope) *resolverGroup {
+	if scope.Value != nil {
+		typ := reflect.Indirect(reflect.ValueOf(scope.Value)).Type()
+		if group, ok := r.byModel[typ]; ok {
+			return group
+		}
+	}
+	return r.global
+}
+
+func (r *Resolver) Name() string { return "gorm:resolver" }
+
+// Initialize wires the resolver into the create/update/delete/query
+// callbacks so routing happens automatically; it's called once by DB.Use.
+func (r *Resolver) Initialize(db *DB) error {
+	go r.healthCheckLoop()
+
+	cb := db.Callback()
+	cb.Create().Before("gorm:create").Register("resolver:route_to_source", r.routeToSource)
+	cb.Update().Before("gorm:update").Register("resolver:route_to_source", r.routeToSource)
+	cb.Delete().Before("gorm:delete").Register("resolver:route_to_source", r.routeToSource)
+	cb.Query().Before("gorm:query").Register("resolver:route_to_replica", r.routeToReplica)
+	cb.RowQuery().Before("gorm:row_query").Register("resolver:route_to_replica", r.routeToReplica)
+	return nil
+}
+
+// healthCheckLoop runs for the resolver's lifetime until Close is called.
+// It recovers from panics in a single tick so a bad replica can't take down
+// the process that installed this plugin.
+func (r *Resolver) healthCheckLoop() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.runHealthCheckTick()
+		}
+	}
+}
+
+func (r *Resolver) runHealthCheckTick() {
+	defer func() {
+		recover()
+	}()
+
+	if r.global != nil {
+		r.global.refreshHealth()
+	}
+	for _, group := range r.byModel {
+		group.refreshHealth()
+	}
+}
+
+// routeToSource always targets the group's source: used for creates,
+// updates and deletes, which must never land on a replica.
+func (r *Resolver) routeToSource(scope *Scope) {
+	r.route(scope, r.groupFor(scope).source(), "source")
+}
+
+// routeToReplica targets a replica unless the statement is inside a
+// transaction or was built with DB.Clauses(gorm.ResolverWrite), either of which
+// forces it onto the source so reads observe the writes around them.
+func (r *Resolver) routeToReplica(scope *Scope) {
+	group := r.groupFor(scope)
+	if scope.db.txCtx != nil || scope.db.hasClause(ResolverWrite) {
+		r.route(scope, group.source(), "source")
+		return
+	}
+	r.route(scope, group.replica(), "replica")
+}
+
+func (r *Resolver) route(scope *Scope, target *DB, role string) {
+	if target == nil {
+		scope.db.err(errors.New("gorm: resolver has no " + role + " to route to"))
+		return
+	}
+	// A statement inside a transaction keeps the transaction's own
+	// connection; only its span is tagged.
+	if _, inTx := scope.db.db.(sqlTx); !inTx {
+		scope.db.db = target.db
+	}
+	if span := opentracing.SpanFromContext(scope.ctx); span != nil {
+		span.SetTag("db.role", role)
+		span.SetTag("db.resolver.name", r.groupFor(scope).name)
+	}
+}
@@ -0,0 +1,50 @@
+package gorm
+
+import "testing"
+
+func TestRoundRobinResolverPolicy(t *testing.T) {
+	dbs := []*DB{{}, {}, {}}
+	policy := NewRoundRobinResolverPolicy()
+
+	for i, want := range []*DB{dbs[0], dbs[1], dbs[2], dbs[0]} {
+		if got := policy.Resolve(dbs); got != want {
+			t.Errorf("round %d: got %p, want %p", i, got, want)
+		}
+	}
+}
+
+func TestWeightedResolverPolicy(t *testing.T) {
+	dbs := []*DB{{}, {}}
+	policy := NewWeightedResolverPolicy([]int{1, 0})
+
+	for i := 0; i < 10; i++ {
+		if got := policy.Resolve(dbs); got != dbs[0] {
+			t.Fatalf("iteration %d: got %p, want dbs[0] (weight 0 entry should never be picked)", i, got)
+		}
+	}
+}
+
+func TestResolverGroupSourceNoSources(t *testing.T) {
+	g := &resolverGroup{policy: RandomResolverPolicy}
+	if got := g.source(); got != nil {
+		t.Errorf("source() with no sources = %p, want nil", got)
+	}
+}
+
+func TestNewResolverDefaultGroupNotNil(t *testing.T) {
+	r := NewResolver()
+	if r.global == nil {
+		t.Fatal("NewResolver() left global nil; routing a model with no registered default group would panic in groupFor's callers")
+	}
+	if got := r.global.source(); got != nil {
+		t.Errorf("source() on the empty default group = %p, want nil", got)
+	}
+}
+
+func TestResolverGroupSourceSingle(t *testing.T) {
+	db := &DB{}
+	g := &resolverGroup{sources: []*DB{db}, policy: RandomResolverPolicy}
+	if got := g.source(); got != db {
+		t.Errorf("source() with one source = %p, want %p", got, db)
+	}
+}
@@ -0,0 +1,64 @@
+package gorm
+
+import (
+	"context"
+	"database/sql"
+)
+
+// sqlCommonContext is the context-aware side of sqlCommon (defined
+// elsewhere in this package). *sql.DB and *sql.Tx both satisfy it;
+// hand-rolled sqlCommon implementations (test doubles, older third-party
+// drivers) may not, so gorm type-asserts for it rather than requiring it
+// outright.
+type sqlCommonContext interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqlDbContext lets Begin honor a caller's context and sql.TxOptions (e.g.
+// isolation level, read-only hints) when the underlying sqlDb supports it.
+type sqlDbContext interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// execContext, queryContext, queryRowContext and prepareContext pass a ctx
+// through to the driver for a single statement. Nothing in this package
+// calls them: Scope.Exec/row/rows/prepare are not defined in these files, so
+// of all the statements gorm runs, only the BeginTx call in Begin receives
+// the caller's ctx.
+
+// execContext runs db.ExecContext when db supports it, and falls back to
+// the context-ignorant Exec otherwise so sqlCommon implementations that
+// predate database/sql's context methods keep working.
+func execContext(ctx context.Context, db sqlCommon, query string, args ...interface{}) (sql.Result, error) {
+	if dbCtx, ok := db.(sqlCommonContext); ok {
+		return dbCtx.ExecContext(ctx, query, args...)
+	}
+	return db.Exec(query, args...)
+}
+
+// queryContext is the Query analog of execContext.
+func queryContext(ctx context.Context, db sqlCommon, query string, args ...interface{}) (*sql.Rows, error) {
+	if dbCtx, ok := db.(sqlCommonContext); ok {
+		return dbCtx.QueryContext(ctx, query, args...)
+	}
+	return db.Query(query, args...)
+}
+
+// queryRowContext is the QueryRow analog of execContext.
+func queryRowContext(ctx context.Context, db sqlCommon, query string, args ...interface{}) *sql.Row {
+	if dbCtx, ok := db.(sqlCommonContext); ok {
+		return dbCtx.QueryRowContext(ctx, query, args...)
+	}
+	return db.QueryRow(query, args...)
+}
+
+// prepareContext is the Prepare analog of execContext.
+func prepareContext(ctx context.Context, db sqlCommon, query string) (*sql.Stmt, error) {
+	if dbCtx, ok := db.(sqlCommonContext); ok {
+		return dbCtx.PrepareContext(ctx, query)
+	}
+	return db.Prepare(query)
+}
@@ -0,0 +1,149 @@
+package gorm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// Span operation names, one per callback chain tracedCallCallbacks can run.
+const (
+	spanOpCreate  = "gorm.create"
+	spanOpQuery   = "gorm.query"
+	spanOpUpdate  = "gorm.update"
+	spanOpDelete  = "gorm.delete"
+	spanOpRaw     = "gorm.raw"
+	spanOpMigrate = "gorm.migrate"
+)
+
+// startCallbackSpan opens the single span for a statement about to run.
+// It replaces the per-NewScope span that used to be opened for every
+// builder call and named after the DSN.
+func startCallbackSpan(scope *Scope, operation string) opentracing.Span {
+	span, ctx := opentracing.StartSpanFromContext(scope.ctx, operation)
+	scope.ctx = ctx
+
+	dbName, dbUser := parseDSN(scope.db.source)
+
+	opentracing.Tag{Key: "component", Value: "gorm"}.Set(span)
+	opentracing.Tag{Key: "span.kind", Value: "client"}.Set(span)
+	opentracing.Tag{Key: "db.type", Value: "sql"}.Set(span)
+	opentracing.Tag{Key: "db.instance", Value: dbName}.Set(span)
+	opentracing.Tag{Key: "db.user", Value: dbUser}.Set(span)
+
+	if tableName := scope.TableName(); tableName != "" {
+		span.SetTag("db.table", tableName)
+	}
+
+	return span
+}
+
+// finishCallbackSpan records the outcome of the statement scope just ran and
+// closes span. It's the counterpart to startCallbackSpan and is called once
+// the statement has run, or has been refused by BlockGlobalUpdate.
+func finishCallbackSpan(span opentracing.Span, scope *Scope) {
+	if !scope.db.disableStmtLog {
+		span.SetTag("db.statement", scope.SQL)
+	}
+	span.SetTag("db.rows_affected", scope.db.RowsAffected)
+
+	if scope.db.Error != nil {
+		span.SetTag("error", true)
+		span.LogFields(
+			log.String("event", "error"),
+			log.String("message", scope.db.Error.Error()),
+		)
+	}
+
+	span.Finish()
+}
+
+// tracedCallCallbacks is the callback boundary: it opens operation's span,
+// runs the statement via run (usually scope.callCallbacks(cbs) for the
+// appropriate cbs list, or a scope helper such as pluck, count or Exec), and
+// finishes the span with the outcome.
+// Taking run as a closure rather than the callback list itself keeps this
+// function from needing to know the list's concrete type.
+//
+// For update/delete it also enforces BlockGlobalUpdate before run executes,
+// so a blocked statement never reaches the database.
+func tracedCallCallbacks(scope *Scope, operation string, run func() *Scope) *Scope {
+	span := startCallbackSpan(scope, operation)
+	start := time.Now()
+
+	if operation == spanOpUpdate || operation == spanOpDelete {
+		if err := checkMissingWhereClause(scope); err != nil {
+			scope.db.err(err)
+			finishCallbackSpan(span, scope)
+			return scope
+		}
+	}
+
+	result := run()
+
+	tagSlowQuery(span, result, time.Since(start))
+	finishCallbackSpan(span, result)
+	return result
+}
+
+// tagSlowQuery flags span as slow once elapsed crosses the DB's configured
+// SetSlowThreshold, and still logs the statement through the usual logger so
+// slow queries show up whether or not a trace is being sampled. Called by
+// tracedCallCallbacks right before finishCallbackSpan.
+func tagSlowQuery(span opentracing.Span, scope *Scope, elapsed time.Duration) {
+	threshold := scope.db.slowThreshold
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+
+	span.SetTag("slow", true)
+	span.SetTag("duration_ms", elapsed.Milliseconds())
+
+	if scope.db.logger != nil {
+		scope.db.logger.Print("sql", fmt.Sprintf("[%.3fms] [SLOW QUERY] %s", float64(elapsed.Nanoseconds())/1e6, scope.SQL))
+	}
+}
+
+// parseDSN pulls the database name and user out of a DSN without ever
+// surfacing the whole string (which may carry a password) to a trace tag.
+// It understands the common "key=value ..." and URL-ish "user:pass@host/db"
+// shapes produced by the mysql/postgres/sqlite drivers; anything else is
+// left blank rather than guessed at.
+func parseDSN(dsn string) (dbName, user string) {
+	// Strip a URL scheme (postgres://, mysql://, ...) first so it isn't
+	// mistaken for the userinfo segment below.
+	rest := dsn
+	if i := strings.Index(rest, "://"); i >= 0 {
+		rest = rest[i+3:]
+	}
+
+	if i := strings.Index(rest, "@"); i >= 0 {
+		// user:password@tcp(host:port)/dbname?params
+		if userinfo := rest[:i]; userinfo != "" {
+			user = strings.SplitN(userinfo, ":", 2)[0]
+		}
+		afterAt := rest[i+1:]
+		if slash := strings.LastIndex(afterAt, "/"); slash >= 0 {
+			dbName = strings.SplitN(afterAt[slash+1:], "?", 2)[0]
+		}
+		return dbName, user
+	}
+
+	for _, field := range strings.Fields(dsn) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "dbname", "database":
+			dbName = kv[1]
+		case "user":
+			user = kv[1]
+		}
+	}
+
+	return dbName, user
+}